@@ -0,0 +1,150 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Checkpoint records a fileStream's read position so that mtail can resume
+// tailing from where it left off across a restart, rather than either
+// re-reading the whole file or skipping over everything written while it
+// was down.
+type Checkpoint struct {
+	Pathname string `json:"pathname"`
+	Inode    uint64 `json:"inode"`
+	Offset   int64  `json:"offset"`
+}
+
+// CheckpointStore persists Checkpoints for a set of streams to a state
+// directory, one file per pathname, periodically flushing whatever has
+// changed since the last flush.  Each write goes to a temp file that is
+// then renamed into place, so a crash mid-write never leaves a corrupt
+// checkpoint for the next startup to trip over.
+type CheckpointStore struct {
+	dir      string
+	interval time.Duration
+
+	mu    sync.Mutex
+	dirty map[string]Checkpoint
+}
+
+// NewCheckpointStore creates a store rooted at dir and starts it flushing
+// dirty checkpoints every interval, for the lifetime of ctx.  A zero
+// interval disables the periodic flush; callers can still call Flush
+// directly, e.g. on shutdown.  Starting the flush loop here rather than
+// leaving it to a separate call mirrors newFileStream's
+// startCloseWatchers: a store that exists is a store that's already
+// live, with nothing further for the owner to remember to wire up.
+func NewCheckpointStore(ctx context.Context, wg *sync.WaitGroup, dir string, interval time.Duration) *CheckpointStore {
+	s := &CheckpointStore{dir: dir, interval: interval, dirty: make(map[string]Checkpoint)}
+	s.run(ctx, wg)
+	return s
+}
+
+// Update records the latest position for pathname, to be written out on
+// the next flush.
+func (s *CheckpointStore) Update(pathname string, inode uint64, offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirty[pathname] = Checkpoint{Pathname: pathname, Inode: inode, Offset: offset}
+}
+
+// Load returns the last persisted checkpoint for pathname, if any.
+func (s *CheckpointStore) Load(pathname string) (Checkpoint, bool) {
+	b, err := os.ReadFile(s.checkpointPath(pathname))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Info(err)
+		}
+		return Checkpoint{}, false
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		glog.Info(err)
+		return Checkpoint{}, false
+	}
+	return cp, true
+}
+
+// resolveStartOffset returns the offset a fileStream should resume from
+// for pathname, validating any persisted Checkpoint's Inode against fi's
+// current file identity first.  It returns zero -- meaning "no checkpoint
+// to resume from" -- if checkpoints is nil, nothing was persisted, or the
+// checkpoint was recorded against a different file than fi: trusting a
+// stale offset into an unrelated file rotated in behind the same pathname
+// would silently skip or misread data instead of streaming from the
+// start/tail as intended.
+func resolveStartOffset(checkpoints *CheckpointStore, pathname string, fi os.FileInfo) int64 {
+	if checkpoints == nil {
+		return 0
+	}
+	cp, ok := checkpoints.Load(pathname)
+	if !ok || cp.Inode != inode(fi) {
+		return 0
+	}
+	return cp.Offset
+}
+
+// run starts a goroutine that flushes dirty checkpoints every interval
+// until ctx is cancelled, at which point it flushes once more before
+// exiting.
+func (s *CheckpointStore) run(ctx context.Context, wg *sync.WaitGroup) {
+	if s.interval <= 0 {
+		return
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				s.Flush()
+				return
+			case <-ticker.C:
+				s.Flush()
+			}
+		}
+	}()
+}
+
+// Flush writes out every checkpoint updated since the last flush.
+func (s *CheckpointStore) Flush() {
+	s.mu.Lock()
+	dirty := s.dirty
+	s.dirty = make(map[string]Checkpoint)
+	s.mu.Unlock()
+	for _, cp := range dirty {
+		if err := s.write(cp); err != nil {
+			glog.Info(err)
+		}
+	}
+}
+
+func (s *CheckpointStore) checkpointPath(pathname string) string {
+	return filepath.Join(s.dir, url.PathEscape(pathname)+".checkpoint")
+}
+
+func (s *CheckpointStore) write(cp Checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	dst := s.checkpointPath(cp.Pathname)
+	tmp := dst + ".tmp"
+	if err := os.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestCheckpointStore builds a store with a discarded ctx/wg: interval
+// is always zero in these tests, so the flush goroutine that run() would
+// otherwise start never gets spawned.
+func newTestCheckpointStore(dir string) *CheckpointStore {
+	return NewCheckpointStore(context.Background(), &sync.WaitGroup{}, dir, 0)
+}
+
+func TestCheckpointStoreLoadMissingReturnsFalse(t *testing.T) {
+	s := newTestCheckpointStore(t.TempDir())
+	if _, ok := s.Load("/var/log/nothing.log"); ok {
+		t.Error("Load() reported success for a path with no checkpoint")
+	}
+}
+
+func TestCheckpointStoreUpdateFlushLoadRoundTrip(t *testing.T) {
+	s := newTestCheckpointStore(t.TempDir())
+	s.Update("/var/log/test.log", 42, 1024)
+	s.Flush()
+
+	got, ok := s.Load("/var/log/test.log")
+	if !ok {
+		t.Fatal("Load() found nothing after Update()+Flush()")
+	}
+	want := Checkpoint{Pathname: "/var/log/test.log", Inode: 42, Offset: 1024}
+	if got != want {
+		t.Errorf("Load() = %+v, want %+v", got, want)
+	}
+}
+
+func TestCheckpointStoreFlushIsAtomic(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestCheckpointStore(dir)
+	s.Update("/var/log/test.log", 1, 100)
+	s.Flush()
+
+	// write() always goes through a .tmp file that's renamed into place,
+	// so no .tmp file should ever be left behind by a completed Flush.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) == ".tmp" {
+			t.Errorf("Flush() left a temp file behind: %s", e.Name())
+		}
+	}
+}
+
+func TestCheckpointStoreFlushClearsDirty(t *testing.T) {
+	s := newTestCheckpointStore(t.TempDir())
+	s.Update("/var/log/test.log", 1, 100)
+	s.Flush()
+	if len(s.dirty) != 0 {
+		t.Errorf("dirty map has %d entries after Flush(), want 0", len(s.dirty))
+	}
+}
+
+// TestCheckpointStoreRunFlushesPeriodically exercises run(), started
+// automatically by NewCheckpointStore: with a nonzero interval, a dirty
+// checkpoint should reach disk on its own without an explicit Flush()
+// call, and stop flushing once ctx is cancelled.
+func TestCheckpointStoreRunFlushesPeriodically(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	s := NewCheckpointStore(ctx, &wg, dir, 10*time.Millisecond)
+	s.Update("/var/log/test.log", 1, 100)
+
+	deadline := time.After(2 * time.Second)
+	for {
+		if _, ok := s.Load("/var/log/test.log"); ok {
+			break
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("run() did not flush the dirty checkpoint before the deadline")
+		}
+	}
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("run()'s flush goroutine did not exit after ctx was cancelled")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// closeConfig describes when a fileStream should stop tailing and close its
+// file descriptor, independent of whether the downstream lines channel is
+// keeping up.  These policies used to be evaluated inline in the read loop
+// via lastReadTime, which meant they could only be checked between reads;
+// if decodeAndSend ever blocked on a full lines channel, the stream could
+// not act on its own timeouts.  The timeout policies, Inactive and
+// AfterInterval, run as separate goroutines that only watch timers and
+// fs.LastReadTime, which keeps shutdown responsive even under
+// backpressure.  OnRenamed, OnRemoved and OnEOF are not run that way: the
+// read loop checks them itself when it reaches EOF.
+type closeConfig struct {
+	// Inactive closes the stream after this long without a successful read.  Zero disables the check.
+	Inactive time.Duration
+	// AfterInterval closes the stream this long after it was opened, regardless of activity.  Zero disables the check.
+	AfterInterval time.Duration
+	// OnRenamed closes the stream once the file has been rotated out from under it, instead of following the new incarnation.
+	OnRenamed bool
+	// OnRemoved closes the stream once the file has been unlinked.
+	OnRemoved bool
+	// OnEOF closes the stream on the first EOF rather than waiting for further writes.
+	OnEOF bool
+}
+
+// startCloseWatchers spawns one goroutine per timeout-based policy
+// configured in cfg.  Each watcher calls fs.Stop() when its condition
+// fires, and exits without ever firing if the stream is stopped or the
+// context is cancelled first.
+func (fs *fileStream) startCloseWatchers(ctx context.Context, wg *sync.WaitGroup, cfg closeConfig) {
+	if cfg.Inactive > 0 {
+		wg.Add(1)
+		go fs.watchInactive(ctx, wg, cfg.Inactive)
+	}
+	if cfg.AfterInterval > 0 {
+		wg.Add(1)
+		go fs.watchAfterInterval(ctx, wg, cfg.AfterInterval)
+	}
+}
+
+// watchInactive stops fs once cfg.Inactive has elapsed since the last
+// successful read, re-arming the timer if a read happened in the meantime.
+func (fs *fileStream) watchInactive(ctx context.Context, wg *sync.WaitGroup, inactive time.Duration) {
+	defer wg.Done()
+	timer := time.NewTimer(inactive)
+	defer timer.Stop()
+	for {
+		select {
+		case <-fs.stopChan:
+			return
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			if idle := time.Since(fs.LastReadTime()); idle < inactive {
+				timer.Reset(inactive - idle)
+				continue
+			}
+			glog.V(2).Infof("%s: closing after %s of inactivity", fs.pathname, inactive)
+			fs.Stop()
+			return
+		}
+	}
+}
+
+// watchAfterInterval stops fs once it has been open for afterInterval,
+// regardless of activity.
+func (fs *fileStream) watchAfterInterval(ctx context.Context, wg *sync.WaitGroup, afterInterval time.Duration) {
+	defer wg.Done()
+	timer := time.NewTimer(afterInterval)
+	defer timer.Stop()
+	select {
+	case <-fs.stopChan:
+	case <-ctx.Done():
+	case <-timer.C:
+		glog.V(2).Infof("%s: closing after %s lifetime", fs.pathname, afterInterval)
+		fs.Stop()
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestFileStream(cfg closeConfig) *fileStream {
+	return &fileStream{
+		streamCommon: streamCommon{
+			pathname:     "test",
+			lastReadTime: time.Now(),
+			stopChan:     make(chan struct{}),
+		},
+		closeCfg: cfg,
+	}
+}
+
+func TestWatchInactiveStopsAfterIdle(t *testing.T) {
+	fs := newTestFileStream(closeConfig{Inactive: 20 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	fs.startCloseWatchers(ctx, &wg, fs.closeCfg)
+
+	select {
+	case <-fs.stopChan:
+	case <-time.After(time.Second):
+		t.Fatal("watchInactive did not call Stop() after the inactive timeout elapsed")
+	}
+	wg.Wait()
+}
+
+func TestWatchInactiveResetsOnRead(t *testing.T) {
+	fs := newTestFileStream(closeConfig{Inactive: 30 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	fs.startCloseWatchers(ctx, &wg, fs.closeCfg)
+
+	// A read shortly before the deadline should re-arm the timer rather
+	// than let the stream close on stale inactivity.
+	time.Sleep(20 * time.Millisecond)
+	fs.recordRead()
+
+	select {
+	case <-fs.stopChan:
+		t.Fatal("watchInactive fired even though a read reset the idle timer")
+	case <-time.After(15 * time.Millisecond):
+	}
+	cancel()
+	wg.Wait()
+}
+
+func TestWatchAfterIntervalStopsRegardlessOfActivity(t *testing.T) {
+	fs := newTestFileStream(closeConfig{AfterInterval: 20 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	fs.startCloseWatchers(ctx, &wg, fs.closeCfg)
+
+	// Keep recording reads so an Inactive-style watcher would never fire;
+	// AfterInterval should close anyway since it only cares about the
+	// stream's total lifetime.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		t := time.NewTicker(time.Millisecond)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				fs.recordRead()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-fs.stopChan:
+	case <-time.After(time.Second):
+		t.Fatal("watchAfterInterval did not call Stop() after its lifetime elapsed")
+	}
+	wg.Wait()
+}
+
+func TestStartCloseWatchersNoopWhenUnconfigured(t *testing.T) {
+	fs := newTestFileStream(closeConfig{})
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	fs.startCloseWatchers(ctx, &wg, fs.closeCfg)
+	cancel()
+	// No watcher goroutines were started, so wg should already be done.
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("wg.Wait() did not return immediately with no close policy configured")
+	}
+}
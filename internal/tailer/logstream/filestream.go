@@ -1,15 +1,18 @@
 // Copyright 2020 Google Inc. All Rights Reserved.
 // This file is available under the Apache license.
 
+//go:build !windows
+// +build !windows
+
 package logstream
 
 import (
 	"bytes"
 	"context"
-	"expvar"
 	"io"
 	"os"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
@@ -17,13 +20,6 @@ import (
 	"github.com/google/mtail/internal/waker"
 )
 
-var (
-	// fileRotations counts the rotations of a file stream
-	fileRotations = expvar.NewMap("file_rotations_total")
-	// fileTruncates counts the truncations of a file stream
-	fileTruncates = expvar.NewMap("file_truncates_total")
-)
-
 // fileStream streams log lines from a regular file on the file system.  These
 // log files are appended to by another process, and are either rotated or
 // truncated by that (or yet another) process.  Rotation implies that a new
@@ -34,45 +30,69 @@ var (
 // logs are not read before truncation occurs.  When an EOF is read, the
 // goroutine tests for both truncation and inode change and resets or spins off
 // a new goroutine and closes itself down.  The shared context is used for
-// cancellation.
+// cancellation.  Rotation is detected by inode identity via os.SameFile;
+// see filestream_windows.go for the file-index-based equivalent used
+// where inodes aren't available.
 type fileStream struct {
-	ctx   context.Context
-	lines chan<- *logline.LogLine
-
-	pathname string // Given name for the underlying file on the filesystem
+	streamCommon
 
-	mu           sync.RWMutex // protects following fields.
-	lastReadTime time.Time    // Last time a log line was read from this file
-	completed    bool         // The filestream is completed and can no longer be used.
-
-	stopOnce sync.Once     // Ensure stopChan only closed once.
-	stopChan chan struct{} // Close to start graceful shutdown.
+	closeCfg    closeConfig      // Policies governing when this stream closes itself.
+	checkpoints *CheckpointStore // Optional offset persistence, nil disables it.
 }
 
-// newFileStream creates a new log stream from a regular file.
-func newFileStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine, streamFromStart bool) (LogStream, error) {
-	fs := &fileStream{ctx: ctx, pathname: pathname, lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}
-	if err := fs.stream(ctx, wg, waker, fi, streamFromStart); err != nil {
+// newFileStream creates a new log stream from a regular file.  Unless
+// streamFromStart is true, a non-nil checkpoints is consulted for a
+// previously persisted offset to resume from; it's only trusted if it was
+// recorded against this same file, per resolveStartOffset.  A nil
+// checkpoints disables offset persistence for this stream.
+func newFileStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine, streamFromStart bool, checkpoints *CheckpointStore, opts LogStreamOptions, cfg closeConfig) (LogStream, error) {
+	fs := &fileStream{streamCommon: streamCommon{ctx: ctx, pathname: pathname, limiter: newRateLimiter(pathname, opts.RateLimit), lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}, closeCfg: cfg, checkpoints: checkpoints}
+	// Started once here, not inside stream(), since stream() recurses on
+	// every rotation against this same fs: starting watchers per
+	// recursion would leak a pair of goroutines per rotation and re-arm
+	// AfterInterval's one-shot timer against the wrong incarnation.
+	fs.startCloseWatchers(ctx, wg, fs.closeCfg)
+	startOffset := resolveStartOffset(checkpoints, pathname, fi)
+	if err := fs.stream(ctx, wg, waker, fi, streamFromStart, startOffset); err != nil {
 		return nil, err
 	}
 	return fs, nil
 }
 
-func (fs *fileStream) LastReadTime() time.Time {
-	fs.mu.RLock()
-	defer fs.mu.RUnlock()
-	return fs.lastReadTime
+// inode returns the platform file identity used to distinguish a rotated
+// file from the one a Checkpoint was recorded against.
+func inode(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino) // nolint:unconvert
+	}
+	return 0
 }
 
-func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, fi os.FileInfo, streamFromStart bool) error {
+func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, fi os.FileInfo, streamFromStart bool, startOffset int64) error {
 	fd, err := os.OpenFile(fs.pathname, os.O_RDONLY, 0600)
 	if err != nil {
 		logErrors.Add(fs.pathname, 1)
 		return err
 	}
 	glog.V(2).Infof("%v: opened new file", fd)
-	if !streamFromStart {
-		if _, err := fd.Seek(0, io.SeekEnd); err != nil {
+	var offset int64
+	switch {
+	case streamFromStart:
+		// offset stays zero; read from the beginning.
+	case startOffset > 0:
+		offset, err = fd.Seek(startOffset, io.SeekStart)
+		if err != nil {
+			logErrors.Add(fs.pathname, 1)
+			if err := fd.Close(); err != nil {
+				logErrors.Add(fs.pathname, 1)
+				glog.Info(err)
+			}
+			return err
+		}
+		glog.V(2).Infof("%v: resumed at checkpointed offset %d", fd, offset)
+	default:
+		offset, err = fd.Seek(0, io.SeekEnd)
+		if err != nil {
 			logErrors.Add(fs.pathname, 1)
 			if err := fd.Close(); err != nil {
 				logErrors.Add(fs.pathname, 1)
@@ -94,6 +114,13 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 				glog.Info(err)
 			}
 		}()
+		// woken is true when the waker has fired since our last EOF check,
+		// meaning some filesystem event (inotify/kqueue/poll) may be
+		// relevant to this path.  Stat is only worth calling in that case;
+		// checking it unconditionally on every idle EOF pass is expensive
+		// across hundreds of mostly-quiet files.  Start true so a rotation
+		// that raced our startup is still caught on the first pass.
+		woken := true
 		for {
 			// Blocking read but regular files will return EOF straight away.
 			count, err := fd.Read(b)
@@ -105,16 +132,33 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 			}
 
 			if count > 0 {
-				glog.V(2).Infof("%v: decode and send", fd)
-				decodeAndSend(ctx, fs.lines, fs.pathname, count, b[:count], partial)
-				fs.mu.Lock()
-				fs.lastReadTime = time.Now()
-				fs.mu.Unlock()
+				if fs.decodeOrDrop(ctx, count, b, partial) {
+					glog.V(2).Infof("%v: dropped %d bytes, rate limit exceeded", fd, count)
+				} else {
+					glog.V(2).Infof("%v: decode and send", fd)
+				}
+				offset += int64(count)
+				fs.recordRead()
+				if fs.checkpoints != nil {
+					fs.checkpoints.Update(fs.pathname, inode(fi), offset)
+				}
 			}
 
 			// If we have read no bytes and are at EOF, check for truncation and rotation.
 			if err == io.EOF && count == 0 {
 				glog.V(2).Infof("%v: eof an no bytes", fd)
+				if fs.closeCfg.OnEOF {
+					glog.V(2).Infof("%v: closing on first EOF per close policy", fd)
+					fs.Stop()
+					goto Sleep
+				}
+				if !woken {
+					// Nothing has told us this path changed since our last
+					// check, so skip the Stat entirely rather than paying
+					// for it on every idle pass.
+					goto Sleep
+				}
+				woken = false
 				// Both rotation and truncation need to stat, so check for rotation first.  It is assumed that rotation is the more common change pattern anyway
 				newfi, serr := os.Stat(fs.pathname)
 				if serr != nil {
@@ -129,28 +173,32 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 					if !os.IsNotExist(serr) {
 						logErrors.Add(fs.pathname, 1)
 					}
+					if os.IsNotExist(serr) && fs.closeCfg.OnRemoved {
+						fs.Stop()
+					}
 					goto Sleep
 				}
 				// TODO existing logstream finished race bug on delete
 				if !os.SameFile(fi, newfi) {
-					glog.V(2).Infof("%v: adding a new file routine", fd)
 					fileRotations.Add(fs.pathname, 1)
-					if err := fs.stream(ctx, wg, waker, newfi, true); err != nil {
+					if fs.closeCfg.OnRenamed {
+						glog.V(2).Infof("%v: closing on rename per close policy", fd)
+						fs.Stop()
+						goto Sleep
+					}
+					glog.V(2).Infof("%v: adding a new file routine", fd)
+					if err := fs.stream(ctx, wg, waker, newfi, true, 0); err != nil {
 						glog.Info(err)
 					}
 					// We're at EOF so there's nothing left to read here.
 					return
 				}
-				currentOffset, serr := fd.Seek(0, io.SeekCurrent)
-				if serr != nil {
-					logErrors.Add(fs.pathname, 1)
-					glog.Info(serr)
-					continue
-				}
-				glog.V(2).Infof("%v: current seek is %d", fd, currentOffset)
-				// We know that newfi is the same file here.
-				if currentOffset != 0 && newfi.Size() < currentOffset {
-					glog.V(2).Infof("%v: truncate? currentoffset is %d and size is %d", fd, currentOffset, newfi.Size())
+				// We know that newfi is the same file here, and offset is
+				// tracked in-process from bytes actually read, so no Seek
+				// syscall is needed to learn the current position.
+				glog.V(2).Infof("%v: current offset is %d", fd, offset)
+				if offset != 0 && newfi.Size() < offset {
+					glog.V(2).Infof("%v: truncate? offset is %d and size is %d", fd, offset, newfi.Size())
 					// About to lose all remaining data because of the truncate so flush the accumulator.
 					if partial.Len() > 0 {
 						sendLine(ctx, fs.pathname, partial, fs.lines)
@@ -160,6 +208,10 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 						logErrors.Add(fs.pathname, 1)
 						glog.Info(serr)
 					}
+					offset = 0
+					if fs.checkpoints != nil {
+						fs.checkpoints.Update(fs.pathname, inode(newfi), offset)
+					}
 					glog.V(2).Infof("%v: Seeked to %d", fd, p)
 					fileTruncates.Add(fs.pathname, 1)
 					continue
@@ -181,18 +233,14 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 					if partial.Len() > 0 {
 						sendLine(ctx, fs.pathname, partial, fs.lines)
 					}
-					fs.mu.Lock()
-					fs.completed = true
-					fs.mu.Unlock()
+					fs.setCompleted()
 					return
 				case <-ctx.Done():
 					glog.V(2).Infof("%v: stream has been cancelled, exiting", fd)
 					if partial.Len() > 0 {
 						sendLine(ctx, fs.pathname, partial, fs.lines)
 					}
-					fs.mu.Lock()
-					fs.completed = true
-					fs.mu.Unlock()
+					fs.setCompleted()
 					return
 				default:
 					// keep going
@@ -217,6 +265,7 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 				glog.V(2).Infof("%v: Cancelled after next read", fd)
 			case <-waker.Wake():
 				// sleep until next Wake()
+				woken = true
 				glog.V(2).Infof("%v: Wake received", fd)
 			}
 		}
@@ -224,16 +273,3 @@ func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 
 	return nil
 }
-
-func (fs *fileStream) IsComplete() bool {
-	fs.mu.RLock()
-	defer fs.mu.RUnlock()
-	return fs.completed
-}
-
-func (fs *fileStream) Stop() {
-	fs.stopOnce.Do(func() {
-		glog.Info("stopping at next EOF")
-		close(fs.stopChan)
-	})
-}
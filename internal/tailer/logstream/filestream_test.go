@@ -0,0 +1,150 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package logstream
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+)
+
+// fakeWaker is a test double for waker.Waker: callers only ever select on
+// the channel Wake returns, so a bare channel satisfies every real caller
+// in this package.
+type fakeWaker struct {
+	c chan struct{}
+}
+
+func newFakeWaker() *fakeWaker {
+	return &fakeWaker{c: make(chan struct{})}
+}
+
+func (w *fakeWaker) Wake() <-chan struct{} {
+	return w.c
+}
+
+func (w *fakeWaker) wake() {
+	w.c <- struct{}{}
+}
+
+func readLine(t *testing.T, lines <-chan *logline.LogLine) *logline.LogLine {
+	t.Helper()
+	select {
+	case l := <-lines:
+		return l
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a line")
+		return nil
+	}
+}
+
+// TestFileStreamSkipsStatUntilWoken exercises the idle-EOF optimization: a
+// rotation that happens without an intervening wake isn't picked up until
+// the waker actually fires, because the stream only pays for a Stat once
+// something has told it this path may have changed.
+func TestFileStreamSkipsStatUntilWoken(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+	if err := os.WriteFile(path, []byte("line1\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 10)
+	w := newFakeWaker()
+
+	if _, err := newFileStream(ctx, &wg, w, path, fi, lines, true, nil, LogStreamOptions{}, closeConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	if l := readLine(t, lines); l.Line != "line1" {
+		t.Errorf("got line %q, want %q", l.Line, "line1")
+	}
+	// Let the stream reach its first EOF and go to sleep before rotating
+	// out from under it.
+	time.Sleep(50 * time.Millisecond)
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("line2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case l := <-lines:
+		t.Fatalf("got line %q before any wake, want rotation to stay undetected until woken", l.Line)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.wake()
+	if l := readLine(t, lines); l.Line != "line2" {
+		t.Errorf("after waking, got line %q, want %q", l.Line, "line2")
+	}
+}
+
+// TestFileStreamIgnoresCheckpointOnInodeMismatch exercises
+// resolveStartOffset: a checkpoint left over from a since-rotated file
+// that reused the same pathname must be ignored, falling back to the
+// normal start-or-end behaviour, rather than seeking into unrelated
+// content at the stale offset.
+func TestFileStreamIgnoresCheckpointOnInodeMismatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+	if err := os.WriteFile(path, []byte("stale line\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 10)
+	w := newFakeWaker()
+
+	checkpoints := NewCheckpointStore(ctx, &wg, t.TempDir(), 0)
+	checkpoints.Update(path, inode(fi)+1, 5) // recorded against a different inode.
+	checkpoints.Flush()                      // resolveStartOffset reads back via Load, which is disk-backed.
+
+	// streamFromStart is false, so with no checkpoint to trust this should
+	// seek to end like any other tail-from-now open, not the stale offset 5.
+	if _, err := newFileStream(ctx, &wg, w, path, fi, lines, false, checkpoints, LogStreamOptions{}, closeConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := appendToFile(t, path, "new line\n"); err != nil {
+		t.Fatal(err)
+	}
+	w.wake()
+	if l := readLine(t, lines); l.Line != "new line" {
+		t.Errorf("got line %q, want %q; a mismatched checkpoint must not be trusted", l.Line, "new line")
+	}
+}
+
+func appendToFile(t *testing.T, path, s string) error {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.WriteString(s)
+	return err
+}
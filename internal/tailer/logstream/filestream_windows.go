@@ -0,0 +1,277 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build windows
+// +build windows
+
+package logstream
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/waker"
+	"golang.org/x/sys/windows"
+)
+
+// fileStream streams log lines from a regular file, mirroring the POSIX
+// implementation in filestream.go.  Windows offers no inode we can compare
+// with os.SameFile across a rename, so rotation is detected by comparing
+// NTFS file indexes (see fileID), falling back to a ModTime/Size snapshot
+// when those can't be read, and the file is opened with sharing flags
+// that let a log rotator rename or delete it out from under us without our
+// read failing.
+type fileStream struct {
+	streamCommon
+
+	closeCfg    closeConfig      // Policies governing when this stream closes itself.
+	checkpoints *CheckpointStore // Optional offset persistence, nil disables it.
+}
+
+// newFileStream creates a new log stream from a regular file.  Unless
+// streamFromStart is true, a non-nil checkpoints is consulted for a
+// previously persisted offset to resume from, per resolveStartOffset.  A
+// nil checkpoints disables offset persistence for this stream.
+func newFileStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine, streamFromStart bool, checkpoints *CheckpointStore, opts LogStreamOptions, cfg closeConfig) (LogStream, error) {
+	fs := &fileStream{streamCommon: streamCommon{ctx: ctx, pathname: pathname, limiter: newRateLimiter(pathname, opts.RateLimit), lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}, closeCfg: cfg, checkpoints: checkpoints}
+	// Started once here, not inside stream(), since stream() recurses on
+	// every rotation against this same fs: starting watchers per
+	// recursion would leak a pair of goroutines per rotation and re-arm
+	// AfterInterval's one-shot timer against the wrong incarnation.
+	fs.startCloseWatchers(ctx, wg, fs.closeCfg)
+	startOffset := resolveStartOffset(checkpoints, pathname, fi)
+	if err := fs.stream(ctx, wg, waker, fi, streamFromStart, startOffset); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// inode returns zero on Windows: there's no os.FileInfo-visible file
+// identity equivalent to a POSIX inode number, so resolveStartOffset's
+// comparison always matches and Checkpoints on this platform are trusted
+// by pathname alone, not cross-checked against the file that produced
+// them.
+func inode(fi os.FileInfo) uint64 {
+	return 0
+}
+
+// openShared opens pathname for reading while allowing another process to
+// read, write, rename or delete it concurrently -- the sharing mode a log
+// rotator needs, which os.Open does not request on Windows.
+func openShared(pathname string) (*os.File, error) {
+	p, err := windows.UTF16PtrFromString(pathname)
+	if err != nil {
+		return nil, err
+	}
+	h, err := windows.CreateFile(
+		p,
+		windows.GENERIC_READ,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil,
+		windows.OPEN_EXISTING,
+		windows.FILE_ATTRIBUTE_NORMAL,
+		0)
+	if err != nil {
+		return nil, err
+	}
+	return os.NewFile(uintptr(h), pathname), nil
+}
+
+// fileID returns NTFS's per-file identity for fd, combined from
+// GetFileInformationByHandle's FileIndexHigh/Low pair.  Unlike ModTime or
+// Size, this can't coincidentally match across a rotation -- a rotator
+// that recreates a file of the same size, or within the same mtime tick
+// as the old one, still gets a new FileIndex -- making it the Windows
+// equivalent of the POSIX os.SameFile rotation check in filestream.go.  It
+// is not used by resolveStartOffset, which relies on inode above.
+func fileID(fd *os.File) (uint64, error) {
+	var info windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(windows.Handle(fd.Fd()), &info); err != nil {
+		return 0, err
+	}
+	return uint64(info.FileIndexHigh)<<32 | uint64(info.FileIndexLow), nil
+}
+
+// probeFileID opens pathname just long enough to read its current fileID,
+// for comparison against an already-open fd's identity.
+func probeFileID(pathname string) (uint64, error) {
+	f, err := openShared(pathname)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return fileID(f)
+}
+
+func (fs *fileStream) stream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, fi os.FileInfo, streamFromStart bool, startOffset int64) error {
+	fd, err := openShared(fs.pathname)
+	if err != nil {
+		logErrors.Add(fs.pathname, 1)
+		return err
+	}
+	glog.V(2).Infof("%v: opened new file", fd)
+	fsID, idErr := fileID(fd)
+	if idErr != nil {
+		glog.Info(idErr)
+	}
+	var offset int64
+	switch {
+	case streamFromStart:
+		// offset stays zero; read from the beginning.
+	case startOffset > 0:
+		offset, err = fd.Seek(startOffset, io.SeekStart)
+		if err != nil {
+			logErrors.Add(fs.pathname, 1)
+			if err := fd.Close(); err != nil {
+				logErrors.Add(fs.pathname, 1)
+				glog.Info(err)
+			}
+			return err
+		}
+		glog.V(2).Infof("%v: resumed at checkpointed offset %d", fd, offset)
+	default:
+		offset, err = fd.Seek(0, io.SeekEnd)
+		if err != nil {
+			logErrors.Add(fs.pathname, 1)
+			if err := fd.Close(); err != nil {
+				logErrors.Add(fs.pathname, 1)
+				glog.Info(err)
+			}
+			return err
+		}
+		glog.V(2).Infof("%v: seeked to end", fd)
+	}
+	b := make([]byte, defaultReadBufferSize)
+	partial := bytes.NewBufferString("")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			glog.V(2).Infof("%v: closing file descriptor", fd)
+			if err := fd.Close(); err != nil {
+				logErrors.Add(fs.pathname, 1)
+				glog.Info(err)
+			}
+		}()
+		// woken mirrors the POSIX implementation: only pay for a Stat once
+		// the polling waker has told us something about this path changed.
+		woken := true
+		for {
+			count, err := fd.Read(b)
+			glog.V(2).Infof("%v: read %d bytes, err is %v", fd, count, err)
+
+			if err != nil && err != io.EOF {
+				glog.Info(err)
+				logErrors.Add(fs.pathname, 1)
+			}
+
+			if count > 0 {
+				if fs.decodeOrDrop(ctx, count, b, partial) {
+					glog.V(2).Infof("%v: dropped %d bytes, rate limit exceeded", fd, count)
+				}
+				offset += int64(count)
+				fs.recordRead()
+				if fs.checkpoints != nil {
+					fs.checkpoints.Update(fs.pathname, inode(fi), offset)
+				}
+			}
+
+			if err == io.EOF && count == 0 {
+				glog.V(2).Infof("%v: eof and no bytes", fd)
+				if fs.closeCfg.OnEOF {
+					fs.Stop()
+					goto Sleep
+				}
+				if !woken {
+					goto Sleep
+				}
+				woken = false
+				newfi, serr := os.Stat(fs.pathname)
+				if serr != nil {
+					glog.Info(serr)
+					if !os.IsNotExist(serr) {
+						logErrors.Add(fs.pathname, 1)
+					}
+					if os.IsNotExist(serr) && fs.closeCfg.OnRemoved {
+						fs.Stop()
+					}
+					goto Sleep
+				}
+				// Prefer comparing fileID, NTFS's inode equivalent: unlike
+				// ModTime/Size, it can't be fooled by a rotator that
+				// recreates a same-size file or lands within the same
+				// mtime tick.  Only fall back to the ModTime/Size
+				// heuristic -- which misses a same-size-or-larger,
+				// same-or-newer-mtime replacement -- if fileID couldn't be
+				// read for either side.  A file now shorter than what's
+				// been read is a truncation, and is reopened the same way.
+				rotated := false
+				if probeID, perr := probeFileID(fs.pathname); idErr == nil && perr == nil {
+					rotated = probeID != fsID || newfi.Size() < offset
+				} else {
+					rotated = newfi.Size() < offset || newfi.ModTime().Before(fi.ModTime())
+				}
+				if rotated {
+					glog.V(2).Infof("%v: rotation or truncation detected, reopening", fd)
+					if partial.Len() > 0 {
+						sendLine(ctx, fs.pathname, partial, fs.lines)
+					}
+					fileRotations.Add(fs.pathname, 1)
+					if fs.closeCfg.OnRenamed {
+						fs.Stop()
+						goto Sleep
+					}
+					if err := fs.stream(ctx, wg, waker, newfi, true, 0); err != nil {
+						glog.Info(err)
+					}
+					return
+				}
+			}
+
+			if err == nil && ctx.Err() == nil {
+				continue
+			}
+
+		Sleep:
+			if err == io.EOF || ctx.Err() != nil {
+				select {
+				case <-fs.stopChan:
+					glog.V(2).Infof("%v: stream has been stopped, exiting", fd)
+					if partial.Len() > 0 {
+						sendLine(ctx, fs.pathname, partial, fs.lines)
+					}
+					fs.setCompleted()
+					return
+				case <-ctx.Done():
+					glog.V(2).Infof("%v: stream has been cancelled, exiting", fd)
+					if partial.Len() > 0 {
+						sendLine(ctx, fs.pathname, partial, fs.lines)
+					}
+					fs.setCompleted()
+					return
+				default:
+					// keep going
+				}
+			}
+
+			glog.V(2).Infof("%v: waiting", fd)
+			select {
+			case <-fs.stopChan:
+				glog.V(2).Infof("%v: Stopping after next read", fd)
+			case <-ctx.Done():
+				glog.V(2).Infof("%v: Cancelled after next read", fd)
+			case <-waker.Wake():
+				woken = true
+				glog.V(2).Infof("%v: Wake received", fd)
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,225 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build linux
+// +build linux
+
+package logstream
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-systemd/v22/sdjournal"
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/waker"
+)
+
+// journaldScheme prefixes a pathname that selects journaldStream instead
+// of a file or pipe, e.g. "journal://_SYSTEMD_UNIT=foo.service" matches
+// entries from that unit.
+const journaldScheme = "journal://"
+
+// newJournaldStreamIfRequested returns ok=false if pathname doesn't use
+// journaldScheme, so New can fall through to its file/pipe handling.
+func newJournaldStreamIfRequested(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, lines chan<- *logline.LogLine, cursorPath string, opts LogStreamOptions) (LogStream, bool, error) {
+	matchSpec, ok := strings.CutPrefix(pathname, journaldScheme)
+	if !ok {
+		return nil, false, nil
+	}
+	ls, err := newJournaldStream(ctx, wg, waker, matchSpec, lines, cursorPath, opts)
+	return ls, true, err
+}
+
+// journaldWaitTimeout bounds how long journaldStream blocks inside
+// Journal.Wait between polls, so that it still notices cancellation and
+// Stop() promptly instead of sitting in an indefinite wait.
+const journaldWaitTimeout = 1 * time.Second
+
+// journaldCursorFlushInterval bounds how often a dirty cursor is actually
+// persisted to disk, the same problem CheckpointStore batches around for
+// file offsets: a busy unit can produce entries fast enough that a
+// write-then-rename per line would dominate CPU/IO.
+const journaldCursorFlushInterval = 1 * time.Second
+
+// journaldStream streams log lines out of systemd-journald via sd_journal,
+// emitting a *logline.LogLine per entry just like fileStream and
+// pipeStream do for their sources.  In place of a filesystem pathname it
+// labels lines with the match expression that selected them.  It embeds
+// streamCommon like the other LogStream implementations so that
+// lastReadTime, completion and shutdown bookkeeping can't drift out of
+// sync with theirs.
+type journaldStream struct {
+	streamCommon
+
+	cursorPath string // Optional path to persist the journal cursor across restarts; empty disables persistence.
+
+	cursorMu    sync.Mutex
+	dirtyCursor string // Set by saveCursor, cleared by flushCursor; empty means nothing to flush.
+}
+
+// newJournaldStream creates a new log stream that reads journal entries
+// matching matchSpec.  If cursorPath is non-empty and holds a cursor
+// written by a previous run, streaming resumes from that cursor; otherwise
+// it seeks to the tail of the journal and only new entries are emitted.
+func newJournaldStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, matchSpec string, lines chan<- *logline.LogLine, cursorPath string, opts LogStreamOptions) (LogStream, error) {
+	js := &journaldStream{
+		streamCommon: streamCommon{ctx: ctx, pathname: matchSpec, limiter: newRateLimiter(matchSpec, opts.RateLimit), lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})},
+		cursorPath:   cursorPath,
+	}
+	if err := js.stream(ctx, wg, waker, matchSpec); err != nil {
+		return nil, err
+	}
+	return js, nil
+}
+
+func (js *journaldStream) stream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, matchSpec string) error {
+	j, err := sdjournal.NewJournal()
+	if err != nil {
+		logErrors.Add(js.pathname, 1)
+		return err
+	}
+	if err := j.AddMatch(matchSpec); err != nil {
+		logErrors.Add(js.pathname, 1)
+		if cerr := j.Close(); cerr != nil {
+			glog.Info(cerr)
+		}
+		return err
+	}
+	if cursor, ok := js.loadCursor(); ok {
+		if err := j.SeekCursor(cursor); err != nil {
+			glog.Info(err)
+			if err := j.SeekTail(); err != nil {
+				logErrors.Add(js.pathname, 1)
+			}
+		} else if _, err := j.NextSkip(1); err != nil {
+			// SeekCursor leaves the read position on the cursor's own
+			// entry, so step past it to avoid re-emitting it.
+			glog.Info(err)
+		}
+	} else if err := j.SeekTail(); err != nil {
+		logErrors.Add(js.pathname, 1)
+		if cerr := j.Close(); cerr != nil {
+			glog.Info(cerr)
+		}
+		return err
+	}
+	glog.V(2).Infof("%s: opened journal stream", js.pathname)
+
+	partial := bytes.NewBufferString("")
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer js.setCompleted()
+		defer js.flushCursor() // persist whatever's still batched before exiting
+		defer func() {
+			glog.V(2).Infof("%s: closing journal", js.pathname)
+			if err := j.Close(); err != nil {
+				logErrors.Add(js.pathname, 1)
+				glog.Info(err)
+			}
+		}()
+		lastCursorFlush := time.Now()
+		for {
+			n, err := j.Next()
+			if err != nil {
+				glog.Info(err)
+				logErrors.Add(js.pathname, 1)
+			}
+
+			if n > 0 {
+				entry, err := j.GetEntry()
+				if err != nil {
+					glog.Info(err)
+					logErrors.Add(js.pathname, 1)
+					continue
+				}
+				msg := entry.Fields["MESSAGE"] + "\n"
+				if js.decodeOrDrop(ctx, len(msg), []byte(msg), partial) {
+					glog.V(2).Infof("%s: dropped entry, rate limit exceeded", js.pathname)
+				}
+				js.saveCursor(entry.Cursor)
+				if time.Since(lastCursorFlush) >= journaldCursorFlushInterval {
+					js.flushCursor()
+					lastCursorFlush = time.Now()
+				}
+				js.recordRead()
+				continue
+			}
+
+			select {
+			case <-js.stopChan:
+				return
+			case <-ctx.Done():
+				return
+			default:
+				// keep going
+			}
+
+			// No new entry: block briefly on the journal itself rather
+			// than the shared waker, since sd_journal has no fd we can
+			// hand to the poller used for files and pipes.
+			if _, err := j.Wait(journaldWaitTimeout); err != nil {
+				glog.Info(err)
+			}
+		}
+	}()
+	return nil
+}
+
+// loadCursor reads a previously persisted journal cursor, if cursorPath is
+// configured and the file exists.
+func (js *journaldStream) loadCursor() (string, bool) {
+	if js.cursorPath == "" {
+		return "", false
+	}
+	b, err := os.ReadFile(js.cursorPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Info(err)
+		}
+		return "", false
+	}
+	return string(b), true
+}
+
+// saveCursor records cursor as the latest position, to be written out on
+// the next flushCursor rather than synchronously here: a busy unit can
+// deliver entries faster than a write-then-rename per line could keep up
+// with, mirroring the batching CheckpointStore does for file offsets.
+func (js *journaldStream) saveCursor(cursor string) {
+	if js.cursorPath == "" {
+		return
+	}
+	js.cursorMu.Lock()
+	js.dirtyCursor = cursor
+	js.cursorMu.Unlock()
+}
+
+// flushCursor persists the latest cursor recorded by saveCursor, if any,
+// via a write-then-rename so a crash mid-write can't leave a corrupt
+// cursor file behind.
+func (js *journaldStream) flushCursor() {
+	js.cursorMu.Lock()
+	cursor := js.dirtyCursor
+	js.dirtyCursor = ""
+	js.cursorMu.Unlock()
+	if cursor == "" {
+		return
+	}
+	tmp := js.cursorPath + ".tmp"
+	if err := os.WriteFile(tmp, []byte(cursor), 0600); err != nil {
+		logErrors.Add(js.pathname, 1)
+		glog.Info(err)
+		return
+	}
+	if err := os.Rename(tmp, js.cursorPath); err != nil {
+		logErrors.Add(js.pathname, 1)
+		glog.Info(err)
+	}
+}
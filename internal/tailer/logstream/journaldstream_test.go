@@ -0,0 +1,108 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build linux
+// +build linux
+
+package logstream
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+)
+
+// TestJournaldStreamCursorRoundTrip exercises the cursor persistence used to
+// resume a journaldStream across restarts, independent of sdjournal itself
+// (which needs a live journald and so isn't exercised here).
+func TestJournaldStreamCursorRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	js := &journaldStream{
+		streamCommon: streamCommon{pathname: "_SYSTEMD_UNIT=test.service"},
+		cursorPath:   filepath.Join(dir, "cursor"),
+	}
+
+	if _, ok := js.loadCursor(); ok {
+		t.Fatal("loadCursor() found a cursor before one was ever saved")
+	}
+
+	// saveCursor only batches in memory; flushCursor is what actually
+	// persists it, same split as CheckpointStore's Update/Flush.
+	js.saveCursor("s=abc123")
+	if _, ok := js.loadCursor(); ok {
+		t.Fatal("loadCursor() found a cursor before flushCursor() ran")
+	}
+	js.flushCursor()
+	got, ok := js.loadCursor()
+	if !ok {
+		t.Fatal("loadCursor() found nothing after saveCursor()+flushCursor()")
+	}
+	if got != "s=abc123" {
+		t.Errorf("loadCursor() = %q, want %q", got, "s=abc123")
+	}
+
+	// A later save+flush should replace the earlier cursor, not append to it.
+	js.saveCursor("s=def456")
+	js.flushCursor()
+	got, ok = js.loadCursor()
+	if !ok || got != "s=def456" {
+		t.Errorf("loadCursor() after second save = (%q, %v), want (%q, true)", got, ok, "s=def456")
+	}
+}
+
+// TestJournaldStreamCursorFlushIsBatched exercises the batching itself:
+// saveCursor must not write through to disk on its own, no matter how many
+// times it's called, until flushCursor actually runs.
+func TestJournaldStreamCursorFlushIsBatched(t *testing.T) {
+	dir := t.TempDir()
+	js := &journaldStream{
+		streamCommon: streamCommon{pathname: "_SYSTEMD_UNIT=test.service"},
+		cursorPath:   filepath.Join(dir, "cursor"),
+	}
+
+	for i := 0; i < 100; i++ {
+		js.saveCursor("s=abc123")
+	}
+	if _, ok := js.loadCursor(); ok {
+		t.Error("loadCursor() found a cursor after saveCursor() alone, want it to stay unflushed")
+	}
+
+	js.flushCursor()
+	if got, ok := js.loadCursor(); !ok || got != "s=abc123" {
+		t.Errorf("loadCursor() after flushCursor() = (%q, %v), want (%q, true)", got, ok, "s=abc123")
+	}
+}
+
+// TestNewDispatchesJournaldScheme exercises newJournaldStreamIfRequested,
+// the check New makes first to recognise the journal:// scheme; the
+// underlying newJournaldStream call is expected to
+// fail here since there's no live journald in the test environment; what
+// matters is that it was reached at all rather than New falling through
+// to treating the pathname as a file.
+func TestNewDispatchesJournaldScheme(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 10)
+
+	_, ok, _ := newJournaldStreamIfRequested(ctx, &wg, nil, "journal://_SYSTEMD_UNIT=test.service", lines, "", LogStreamOptions{})
+	if !ok {
+		t.Error("newJournaldStreamIfRequested() did not recognise the journal:// scheme")
+	}
+
+	_, ok, _ = newJournaldStreamIfRequested(ctx, &wg, nil, filepath.Join(t.TempDir(), "test.log"), lines, "", LogStreamOptions{})
+	if ok {
+		t.Error("newJournaldStreamIfRequested() claimed a plain file path")
+	}
+}
+
+func TestJournaldStreamCursorDisabledWhenPathEmpty(t *testing.T) {
+	js := &journaldStream{streamCommon: streamCommon{pathname: "test"}}
+	js.saveCursor("s=abc123") // must be a no-op: no cursorPath configured
+	if _, ok := js.loadCursor(); ok {
+		t.Error("loadCursor() reported a cursor with persistence disabled")
+	}
+}
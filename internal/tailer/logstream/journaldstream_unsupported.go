@@ -0,0 +1,33 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !linux
+// +build !linux
+
+package logstream
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/waker"
+)
+
+// journaldScheme mirrors the constant in journaldstream.go so New can
+// recognise a journal:// pathname and report a clear error instead of
+// trying to open it as a file or pipe, on platforms without sd_journal
+// (this covers Windows too, which has no sdjournal of its own).
+const journaldScheme = "journal://"
+
+// newJournaldStreamIfRequested reports an error for a journal:// pathname
+// on this platform, since sdjournal is Linux-only; it returns ok=false for
+// any other pathname so New can fall through to its file/pipe handling.
+func newJournaldStreamIfRequested(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, lines chan<- *logline.LogLine, cursorPath string, opts LogStreamOptions) (LogStream, bool, error) {
+	if !strings.HasPrefix(pathname, journaldScheme) {
+		return nil, false, nil
+	}
+	return nil, true, fmt.Errorf("journald log streams are not supported on this platform: %s", pathname)
+}
@@ -0,0 +1,34 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package logstream
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/waker"
+)
+
+// New creates the LogStream implementation appropriate for pathname: a
+// journaldStream for the journal:// scheme (see journaldScheme), a
+// pipeStream for a named pipe, or a fileStream for anything else.  This is
+// the single entry point a Tailer should call once it has decided a path
+// is worth following, so that stream-wide options like a rate limit or a
+// close policy have somewhere to be threaded in from outside the package.
+// checkpoints may be nil to disable offset persistence; it has no effect
+// on journaldStream, which persists its own cursor via cursorPath instead.
+func New(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine, streamFromStart bool, cursorPath string, checkpoints *CheckpointStore, opts LogStreamOptions, cfg closeConfig) (LogStream, error) {
+	if ls, ok, err := newJournaldStreamIfRequested(ctx, wg, waker, pathname, lines, cursorPath, opts); ok {
+		return ls, err
+	}
+	if fi.Mode()&os.ModeNamedPipe != 0 {
+		return newPipeStream(ctx, wg, waker, pathname, fi, lines, opts)
+	}
+	return newFileStream(ctx, wg, waker, pathname, fi, lines, streamFromStart, checkpoints, opts, cfg)
+}
@@ -0,0 +1,59 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package logstream
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+)
+
+// TestNewDispatchesOnFileType exercises New's job of picking the right
+// LogStream implementation for a path without the caller having to know
+// fileStream from pipeStream itself.
+func TestNewDispatchesOnFileType(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+	if err := os.WriteFile(path, []byte("a line\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 10)
+	w := newFakeWaker()
+
+	ls, err := New(ctx, &wg, w, path, fi, lines, true, "", nil, LogStreamOptions{}, closeConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ls.(*fileStream); !ok {
+		t.Errorf("New() on a regular file returned %T, want *fileStream", ls)
+	}
+
+	pipePath := mkfifoOrSkip(t)
+	fi, err = os.Stat(pipePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err = New(ctx, &wg, w, pipePath, fi, lines, true, "", nil, LogStreamOptions{}, closeConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ls.(*pipeStream); !ok {
+		t.Errorf("New() on a named pipe returned %T, want *pipeStream", ls)
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build windows
+// +build windows
+
+package logstream
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/waker"
+)
+
+// New creates the LogStream implementation appropriate for pathname: an
+// error for the journal:// scheme (see journaldScheme; sdjournal is
+// Linux-only), a pipeStream if isPipe is true, or a fileStream otherwise.
+// Unlike POSIX, a Windows named pipe has to be created by mtail itself
+// rather than opened by stat-ing an existing path, so the caller -- which
+// already knows whether it configured pathname as a pipe -- tells New
+// directly via isPipe instead of New inferring it from fi.  Parameters up
+// to cursorPath match the POSIX New in logstream.go; isPipe has no POSIX
+// equivalent since a FIFO there is just a pathname New can stat like any
+// other.  checkpoints may be nil to disable offset persistence.
+func New(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine, streamFromStart bool, cursorPath string, isPipe bool, checkpoints *CheckpointStore, opts LogStreamOptions, cfg closeConfig) (LogStream, error) {
+	if ls, ok, err := newJournaldStreamIfRequested(ctx, wg, waker, pathname, lines, cursorPath, opts); ok {
+		return ls, err
+	}
+	if isPipe {
+		return newPipeStream(ctx, wg, waker, pathname, fi, lines, opts)
+	}
+	return newFileStream(ctx, wg, waker, pathname, fi, lines, streamFromStart, checkpoints, opts, cfg)
+}
@@ -0,0 +1,64 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build windows
+// +build windows
+
+package logstream
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/google/mtail/internal/logline"
+)
+
+// TestNewDispatchesOnFileType exercises New's job of picking the right
+// LogStream implementation for a path without the caller having to know
+// fileStream from pipeStream itself; pipeStream dispatch isn't covered
+// here since it needs a real named pipe client/server pair to exercise.
+func TestNewDispatchesOnFileType(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.log")
+	if err := os.WriteFile(path, []byte("a line\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 10)
+	w := newFakeWaker()
+
+	ls, err := New(ctx, &wg, w, path, fi, lines, true, "", false, nil, LogStreamOptions{}, closeConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ls.(*fileStream); !ok {
+		t.Errorf("New() on a regular file returned %T, want *fileStream", ls)
+	}
+}
+
+// TestNewRejectsJournaldScheme exercises New's handling of the journal://
+// scheme on Windows, where sdjournal isn't available: it should report a
+// clear error rather than falling through to fileStream/pipeStream and
+// failing with a confusing "file not found".
+func TestNewRejectsJournaldScheme(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 10)
+	w := newFakeWaker()
+
+	_, err := New(ctx, &wg, w, "journal://_SYSTEMD_UNIT=test.service", nil, lines, true, "", false, nil, LogStreamOptions{}, closeConfig{})
+	if err == nil {
+		t.Error("New() on a journal:// pathname returned a nil error, want an unsupported-platform error")
+	}
+}
@@ -1,6 +1,9 @@
 // Copyright 2020 Google Inc. All Rights Reserved.
 // This file is available under the Apache license.
 
+//go:build !windows
+// +build !windows
+
 package logstream
 
 import (
@@ -18,33 +21,17 @@ import (
 )
 
 type pipeStream struct {
-	ctx   context.Context
-	lines chan<- *logline.LogLine
-
-	pathname string // Given name for the underlying named pipe on the filesystem
-
-	mu           sync.RWMutex // protects following fields
-	completed    bool         // This pipestream is completed and can no longer be used.
-	lastReadTime time.Time    // Last time a log line was read from this named pipe
-
-	stopOnce sync.Once     // Ensure stopChan only closed once.
-	stopChan chan struct{} // Close to start graceful shutdown.
+	streamCommon
 }
 
-func newPipeStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine) (LogStream, error) {
-	ps := &pipeStream{ctx: ctx, pathname: pathname, lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}
+func newPipeStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine, opts LogStreamOptions) (LogStream, error) {
+	ps := &pipeStream{streamCommon{ctx: ctx, pathname: pathname, limiter: newRateLimiter(pathname, opts.RateLimit), lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}}
 	if err := ps.stream(ctx, wg, waker, fi); err != nil {
 		return nil, err
 	}
 	return ps, nil
 }
 
-func (ps *pipeStream) LastReadTime() time.Time {
-	ps.mu.RLock()
-	defer ps.mu.RUnlock()
-	return ps.lastReadTime
-}
-
 func (ps *pipeStream) stream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, fi os.FileInfo) error {
 	// Open in nonblocking mode because the write end of the pipe may not have started yet.
 	fd, err := os.OpenFile(ps.pathname, os.O_RDONLY|syscall.O_NONBLOCK, 0600)
@@ -53,80 +40,80 @@ func (ps *pipeStream) stream(ctx context.Context, wg *sync.WaitGroup, waker wake
 		return err
 	}
 	glog.V(2).Infof("opened new pipe %v", fd)
+	rc, err := fd.SyscallConn()
+	if err != nil {
+		logErrors.Add(ps.pathname, 1)
+		if cerr := fd.Close(); cerr != nil {
+			glog.Info(cerr)
+		}
+		return err
+	}
+
+	// Closing fd is what unblocks a Read parked in the runtime netpoller
+	// below; there's no longer an idle read deadline to cycle through
+	// just to notice cancellation.
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		defer func() {
-			err := fd.Close()
-			if err != nil {
-				logErrors.Add(ps.pathname, 1)
-				glog.Info(err)
-			}
-			ps.mu.Lock()
-			ps.completed = true
-			ps.mu.Unlock()
-		}()
-		b := make([]byte, 0, defaultReadBufferSize)
-		capB := cap(b)
+		select {
+		case <-ps.stopChan:
+		case <-ctx.Done():
+		}
+		if err := fd.Close(); err != nil {
+			glog.V(2).Infof("%s: %s", ps.pathname, err)
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer ps.setCompleted()
+		// Stop() closes stopChan, which is what tells the watcher
+		// goroutine above to close fd and exit.  Without this, a pipe
+		// that ends normally (writer closed its end) would leak both
+		// fd and that goroutine until something external happened to
+		// call Stop() or cancel ctx.
+		defer ps.Stop()
+		b := make([]byte, defaultReadBufferSize)
 		partial := bytes.NewBufferString("")
 		for {
-			// Set idle timeout
-			if err := fd.SetReadDeadline(time.Now().Add(defaultReadTimeout)); err != nil {
-				logErrors.Add(ps.pathname, 1)
-				glog.V(2).Infof("%s: %s", ps.pathname, err)
-			}
-			n, err := fd.Read(b[:capB])
-			if e, ok := err.(*os.PathError); ok && e.Timeout() && n == 0 {
-				// Named Pipes EOF when the writer has closed, so we look for a
-				// timeout on read to detect a writer stall and thus let us check
-				// below for cancellation.
-				goto Sleep
-			}
-			// Per pipe(7): If all file descriptors referring to the write end
-			// of a pipe have been closed, then an attempt to read(2) from the
-			// pipe will see end-of-file (read(2) will return 0).
-			// All other errors also finish the stream and are counted.
-			if err != nil {
-				if err != io.EOF {
-					glog.Info(err)
-					logErrors.Add(ps.pathname, 1)
-				}
+			var n int
+			var readErr error
+			// rc.Read parks this goroutine on the runtime netpoller until
+			// the kernel reports fd readable (or closed), rather than
+			// spinning on a read deadline; the callback fires once per
+			// actual wakeup and reports whether that wakeup produced
+			// data or was a stale EAGAIN.
+			pollErr := rc.Read(func(fdRaw uintptr) bool {
+				n, readErr = syscall.Read(int(fdRaw), b)
+				return readErr != syscall.EAGAIN
+			})
+			if pollErr != nil {
+				// fd was closed out from under us above, by our own
+				// cancellation or an external Stop().
 				return
 			}
 
 			if n > 0 {
-				decodeAndSend(ps.ctx, ps.lines, ps.pathname, n, b[:n], partial)
+				if ps.decodeOrDrop(ctx, n, b[:n], partial) {
+					glog.V(2).Infof("%s: dropped %d bytes, rate limit exceeded", ps.pathname, n)
+				}
 				// Update the last read time if we were able to read anything.
-				ps.lastReadTime = time.Now()
+				ps.recordRead()
 			}
-		Sleep:
-			select {
-			case <-ps.stopChan:
-				ps.mu.Lock()
-				ps.completed = true
-				ps.mu.Unlock()
-				return
-			case <-ctx.Done():
-				ps.mu.Lock()
-				ps.completed = true
-				ps.mu.Unlock()
+
+			// Per pipe(7): if all file descriptors referring to the write
+			// end of a pipe have been closed, read(2) sees end-of-file,
+			// i.e. n == 0 with no error.  Any other error also finishes
+			// the stream and is counted.
+			if readErr != nil || n == 0 {
+				if readErr != nil && readErr != io.EOF {
+					glog.Info(readErr)
+					logErrors.Add(ps.pathname, 1)
+				}
 				return
-			case <-waker.Wake():
-				// sleep until next Wake()
 			}
 		}
 	}()
 	return nil
 }
-
-func (ps *pipeStream) IsComplete() bool {
-	ps.mu.RLock()
-	defer ps.mu.RUnlock()
-	return ps.completed
-}
-
-func (ps *pipeStream) Stop() {
-	ps.stopOnce.Do(func() {
-		close(ps.stopChan)
-	})
-}
@@ -0,0 +1,128 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package logstream
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+)
+
+// mkfifoOrSkip creates a named pipe in a fresh temp dir, skipping the test
+// on platforms where syscall.Mkfifo isn't available.
+func mkfifoOrSkip(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.fifo")
+	if err := syscall.Mkfifo(path, 0600); err != nil {
+		t.Skipf("Mkfifo unsupported on this platform: %v", err)
+	}
+	return path
+}
+
+// TestPipeStreamReadsViaNetpoller exercises the runtime-netpoller-driven
+// read loop: writes to the pipe should be delivered as lines without any
+// read-deadline polling.
+func TestPipeStreamReadsViaNetpoller(t *testing.T) {
+	pipePath := mkfifoOrSkip(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 10)
+
+	go func() {
+		wf, err := os.OpenFile(pipePath, os.O_WRONLY, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer wf.Close()
+		if _, err := wf.WriteString("hello\n"); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	fi, err := os.Stat(pipePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newPipeStream(ctx, &wg, nil, pipePath, fi, lines, LogStreamOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case l := <-lines:
+		if l.Line != "hello" {
+			t.Errorf("got line %q, want %q", l.Line, "hello")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a line from the pipe")
+	}
+}
+
+// TestPipeStreamStopsOnWriterClose is the regression test for the fd/goroutine
+// leak: once the writer closes its end of the pipe, the read loop must
+// notice EOF, mark itself complete, and stop the stream so the paired
+// fd-closer goroutine exits and closes fd -- without anything external
+// calling Stop() or cancelling ctx.
+func TestPipeStreamStopsOnWriterClose(t *testing.T) {
+	pipePath := mkfifoOrSkip(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	lines := make(chan *logline.LogLine, 10)
+
+	// Opening a FIFO for write-only blocks until a reader opens the other
+	// end, so this has to happen concurrently with newPipeStream below
+	// rather than before it.
+	go func() {
+		wf, err := os.OpenFile(pipePath, os.O_WRONLY, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if _, err := wf.WriteString("only line\n"); err != nil {
+			t.Error(err)
+		}
+		if err := wf.Close(); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	fi, err := os.Stat(pipePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ls, err := newPipeStream(ctx, &wg, nil, pipePath, fi, lines, LogStreamOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := ls.(*pipeStream)
+
+	<-lines // "only line"
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("read-loop and fd-closer goroutines did not exit after the writer closed the pipe")
+	}
+	if !ps.IsComplete() {
+		t.Error("pipeStream not marked complete after the writer closed its end")
+	}
+}
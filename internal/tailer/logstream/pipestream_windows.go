@@ -0,0 +1,117 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build windows
+// +build windows
+
+package logstream
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/google/mtail/internal/logline"
+	"github.com/google/mtail/internal/waker"
+	"golang.org/x/sys/windows"
+)
+
+// pipeStream streams log lines from a Windows named pipe.  Unlike a POSIX
+// FIFO, which some other process creates with mkfifo and mtail simply
+// opens, a \\.\pipe\... instance has to be created by one side or the
+// other; mtail creates the pipe and waits for a writer to connect to it.
+type pipeStream struct {
+	streamCommon
+}
+
+func newPipeStream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, pathname string, fi os.FileInfo, lines chan<- *logline.LogLine, opts LogStreamOptions) (LogStream, error) {
+	ps := &pipeStream{streamCommon{ctx: ctx, pathname: pathname, limiter: newRateLimiter(pathname, opts.RateLimit), lastReadTime: time.Now(), lines: lines, stopChan: make(chan struct{})}}
+	if err := ps.stream(ctx, wg, waker, fi); err != nil {
+		return nil, err
+	}
+	return ps, nil
+}
+
+func (ps *pipeStream) stream(ctx context.Context, wg *sync.WaitGroup, waker waker.Waker, fi os.FileInfo) error {
+	p, err := windows.UTF16PtrFromString(ps.pathname)
+	if err != nil {
+		logErrors.Add(ps.pathname, 1)
+		return err
+	}
+	h, err := windows.CreateNamedPipe(
+		p,
+		// FILE_FLAG_OVERLAPPED is required for fd.SetReadDeadline below to
+		// have any effect: Go's os package only associates a Windows
+		// handle with its deadline-aware I/O poller if the handle was
+		// opened for overlapped I/O, the same reason libraries like
+		// go-winio always set this flag on a pipe handle they intend to
+		// drive with deadlines.
+		windows.PIPE_ACCESS_INBOUND|windows.FILE_FLAG_OVERLAPPED,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT,
+		windows.PIPE_UNLIMITED_INSTANCES,
+		0, uint32(defaultReadBufferSize), 0, nil)
+	if err != nil {
+		logErrors.Add(ps.pathname, 1)
+		return err
+	}
+	glog.V(2).Infof("%s: created named pipe, waiting for a writer to connect", ps.pathname)
+	if err := windows.ConnectNamedPipe(h, nil); err != nil && err != windows.ERROR_PIPE_CONNECTED {
+		logErrors.Add(ps.pathname, 1)
+		if cerr := windows.CloseHandle(h); cerr != nil {
+			glog.Info(cerr)
+		}
+		return err
+	}
+	fd := os.NewFile(uintptr(h), ps.pathname)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			if err := fd.Close(); err != nil {
+				logErrors.Add(ps.pathname, 1)
+				glog.Info(err)
+			}
+			ps.setCompleted()
+		}()
+		b := make([]byte, defaultReadBufferSize)
+		partial := bytes.NewBufferString("")
+		for {
+			if err := fd.SetReadDeadline(time.Now().Add(defaultReadTimeout)); err != nil {
+				logErrors.Add(ps.pathname, 1)
+				glog.V(2).Infof("%s: %s", ps.pathname, err)
+			}
+			n, err := fd.Read(b)
+			if e, ok := err.(*os.PathError); ok && e.Timeout() && n == 0 {
+				// A read timeout just means no writer has sent anything
+				// yet; loop back around to check for cancellation.
+				goto Sleep
+			}
+			if err != nil {
+				glog.Info(err)
+				logErrors.Add(ps.pathname, 1)
+				return
+			}
+
+			if n > 0 {
+				if ps.decodeOrDrop(ctx, n, b, partial) {
+					glog.V(2).Infof("%s: dropped %d bytes, rate limit exceeded", ps.pathname, n)
+				}
+				ps.recordRead()
+			}
+		Sleep:
+			select {
+			case <-ps.stopChan:
+				return
+			case <-ctx.Done():
+				return
+			case <-waker.Wake():
+				// sleep until next Wake()
+			}
+		}
+	}()
+	return nil
+}
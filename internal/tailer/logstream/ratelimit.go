@@ -0,0 +1,164 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// maxRateLimitDeficit caps how long a single call to rateLimiter.wait will
+// ever ask the caller to sleep, no matter how deep a burst after an idle
+// period has driven a bucket negative.  Without this, one big catch-up
+// read could compute an arbitrarily long deficit and effectively wedge
+// the read loop even though the select below is cancellable.
+const maxRateLimitDeficit = 10 * time.Second
+
+var (
+	// linesDropped counts the lines dropped per path because a rate limit
+	// was configured in Drop mode and the bucket ran dry.
+	linesDropped = expvar.NewMap("log_lines_dropped_total")
+)
+
+// RateLimitMode selects what a rate-limited stream does once its bucket is
+// empty.
+type RateLimitMode int
+
+const (
+	// RateLimitBlock sleeps for the deficit before letting the read proceed.
+	RateLimitBlock RateLimitMode = iota
+	// RateLimitDrop discards the chunk just read and counts its lines in linesDropped.
+	RateLimitDrop
+)
+
+// LogStreamOptions carries stream configuration that isn't specific to a
+// single filesystem path, so that new knobs don't require changing the
+// signature of every LogStream constructor again.
+type LogStreamOptions struct {
+	// RateLimit configures a leaky-bucket limiter for this stream.  A nil
+	// RateLimit disables limiting, which is the default.
+	RateLimit *RateLimitConfig
+}
+
+// RateLimitConfig configures a leaky-bucket rate limiter for a LogStream.
+type RateLimitConfig struct {
+	// LinesPerSec is the sustained rate of lines permitted per second.  Zero disables the lines limit.
+	LinesPerSec float64
+	// BytesPerSec is the sustained rate of bytes permitted per second.  Zero disables the bytes limit.
+	BytesPerSec float64
+	// Mode chooses what happens when the bucket runs dry.
+	Mode RateLimitMode
+}
+
+// leakyBucket is a token bucket that refills continuously based on elapsed
+// wall-clock time, so that it costs nothing while the stream is idle.
+type leakyBucket struct {
+	mu sync.Mutex
+
+	size         float64       // current token count
+	capacity     float64       // maximum token count
+	fillInterval time.Duration // time to accumulate one token
+	lastEvent    time.Time     // last time the bucket was refilled
+}
+
+func newLeakyBucket(ratePerSec, capacity float64) *leakyBucket {
+	return &leakyBucket{
+		size:         capacity,
+		capacity:     capacity,
+		fillInterval: time.Duration(float64(time.Second) / ratePerSec),
+		lastEvent:    time.Now(),
+	}
+}
+
+// refill adds tokens for the time elapsed since lastEvent, clamped to capacity.  Caller must hold mu.
+func (b *leakyBucket) refill() {
+	now := time.Now()
+	elapsed := now.Sub(b.lastEvent)
+	b.lastEvent = now
+	if b.fillInterval <= 0 {
+		return
+	}
+	b.size += float64(elapsed) / float64(b.fillInterval)
+	if b.size > b.capacity {
+		b.size = b.capacity
+	}
+}
+
+// consume removes n tokens and reports how long the caller should sleep to
+// cover the deficit, or zero if there was none.
+func (b *leakyBucket) consume(n float64) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.size -= n
+	if b.size >= 0 || b.fillInterval <= 0 {
+		return 0
+	}
+	return time.Duration(-b.size * float64(b.fillInterval))
+}
+
+// rateLimiter enforces the optional line- and byte-rate limits configured
+// for a single stream's path.
+type rateLimiter struct {
+	pathname string
+	mode     RateLimitMode
+	lines    *leakyBucket
+	bytes    *leakyBucket
+}
+
+// newRateLimiter returns nil if cfg is nil, so callers can treat a nil
+// *rateLimiter as "no limiting" without a separate enabled flag.
+func newRateLimiter(pathname string, cfg *RateLimitConfig) *rateLimiter {
+	if cfg == nil {
+		return nil
+	}
+	rl := &rateLimiter{pathname: pathname, mode: cfg.Mode}
+	if cfg.LinesPerSec > 0 {
+		rl.lines = newLeakyBucket(cfg.LinesPerSec, cfg.LinesPerSec)
+	}
+	if cfg.BytesPerSec > 0 {
+		rl.bytes = newLeakyBucket(cfg.BytesPerSec, cfg.BytesPerSec)
+	}
+	return rl
+}
+
+// wait charges count lines and n bytes against the limiter, blocking for
+// the deficit in RateLimitBlock mode.  It reports true in RateLimitDrop mode
+// if the caller should discard this chunk instead of sending it on.  The
+// block is interruptible via ctx and stopChan so that a deep deficit can't
+// keep a stream's read loop from noticing cancellation.
+func (rl *rateLimiter) wait(ctx context.Context, stopChan <-chan struct{}, count, n int) bool {
+	if rl == nil {
+		return false
+	}
+	var deficit time.Duration
+	if rl.lines != nil {
+		if d := rl.lines.consume(float64(count)); d > deficit {
+			deficit = d
+		}
+	}
+	if rl.bytes != nil {
+		if d := rl.bytes.consume(float64(n)); d > deficit {
+			deficit = d
+		}
+	}
+	if deficit == 0 {
+		return false
+	}
+	if rl.mode == RateLimitDrop {
+		linesDropped.Add(rl.pathname, int64(count))
+		return true
+	}
+	if deficit > maxRateLimitDeficit {
+		deficit = maxRateLimitDeficit
+	}
+	select {
+	case <-time.After(deficit):
+	case <-ctx.Done():
+	case <-stopChan:
+	}
+	return false
+}
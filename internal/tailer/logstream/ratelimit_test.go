@@ -0,0 +1,77 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLeakyBucketConsume(t *testing.T) {
+	b := newLeakyBucket(10, 10) // 10 tokens/sec, capacity 10
+	if d := b.consume(5); d != 0 {
+		t.Errorf("consume(5) on a full bucket = %v, want 0", d)
+	}
+	if d := b.consume(10); d <= 0 {
+		t.Errorf("consume(10) against a 5-token bucket = %v, want > 0", d)
+	}
+}
+
+func TestRateLimiterNilIsNoop(t *testing.T) {
+	var rl *rateLimiter
+	if rl.wait(context.Background(), nil, 1, 100) {
+		t.Error("nil rateLimiter.wait() = true, want false (unlimited)")
+	}
+}
+
+func TestRateLimiterDropMode(t *testing.T) {
+	rl := newRateLimiter("test", &RateLimitConfig{LinesPerSec: 1, Mode: RateLimitDrop})
+	// First line drains the one-token bucket; the second should be reported
+	// as droppable rather than blocking.
+	if rl.wait(context.Background(), nil, 1, 0) {
+		t.Fatal("first line unexpectedly reported as dropped")
+	}
+	if !rl.wait(context.Background(), nil, 1, 0) {
+		t.Error("second line over a 1/sec limit in Drop mode was not reported as dropped")
+	}
+}
+
+func TestRateLimiterBlockModeInterruptibleByStopChan(t *testing.T) {
+	rl := newRateLimiter("test", &RateLimitConfig{LinesPerSec: 1, Mode: RateLimitBlock})
+	rl.wait(context.Background(), nil, 1, 0) // drain the bucket
+
+	stopChan := make(chan struct{})
+	close(stopChan)
+
+	done := make(chan struct{})
+	go func() {
+		rl.wait(context.Background(), stopChan, 1, 0)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("wait() did not return promptly when stopChan was already closed")
+	}
+}
+
+func TestRateLimiterBlockModeInterruptibleByContext(t *testing.T) {
+	rl := newRateLimiter("test", &RateLimitConfig{LinesPerSec: 1, Mode: RateLimitBlock})
+	rl.wait(context.Background(), nil, 1, 0) // drain the bucket
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		rl.wait(ctx, nil, 1, 0)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("wait() did not return promptly when ctx was already cancelled")
+	}
+}
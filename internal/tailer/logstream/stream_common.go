@@ -0,0 +1,88 @@
+// Copyright 2020 Google Inc. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logstream
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/google/mtail/internal/logline"
+)
+
+var (
+	// fileRotations counts the rotations of a file stream, on any platform.
+	fileRotations = expvar.NewMap("file_rotations_total")
+	// fileTruncates counts the truncations of a file stream.  Only the POSIX
+	// fileStream tells a truncation apart from a rotation; the Windows one
+	// reopens the file in both cases and counts it in fileRotations.
+	fileTruncates = expvar.NewMap("file_truncates_total")
+)
+
+// streamCommon holds the state and bookkeeping shared by every LogStream
+// implementation that reads a byte stream and decodes it into log lines:
+// fileStream and pipeStream on POSIX, and their Windows counterparts.
+// Factoring it out here means the platform-specific variants can't drift
+// out of sync on how lastReadTime, completion and shutdown are tracked.
+type streamCommon struct {
+	ctx   context.Context
+	lines chan<- *logline.LogLine
+
+	pathname string // Given name for the underlying source on the filesystem.
+
+	limiter *rateLimiter // Optional leaky-bucket limiter, nil if unconfigured.
+
+	mu           sync.RWMutex // protects following fields.
+	lastReadTime time.Time    // Last time a log line was read from this source.
+	completed    bool         // The stream is completed and can no longer be used.
+
+	stopOnce sync.Once     // Ensure stopChan only closed once.
+	stopChan chan struct{} // Close to start graceful shutdown.
+}
+
+func (c *streamCommon) LastReadTime() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastReadTime
+}
+
+func (c *streamCommon) IsComplete() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.completed
+}
+
+func (c *streamCommon) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.stopChan)
+	})
+}
+
+// recordRead marks that a read just succeeded, updating lastReadTime.
+func (c *streamCommon) recordRead() {
+	c.mu.Lock()
+	c.lastReadTime = time.Now()
+	c.mu.Unlock()
+}
+
+// setCompleted marks the stream finished; callers should do this exactly
+// once, immediately before their read loop returns.
+func (c *streamCommon) setCompleted() {
+	c.mu.Lock()
+	c.completed = true
+	c.mu.Unlock()
+}
+
+// decodeOrDrop applies the configured rate limit to a freshly read chunk
+// and, unless it should be dropped, decodes and sends it on to lines.  It
+// reports whether the chunk was dropped.
+func (c *streamCommon) decodeOrDrop(ctx context.Context, count int, b []byte, partial *bytes.Buffer) bool {
+	if c.limiter.wait(ctx, c.stopChan, bytes.Count(b[:count], []byte("\n")), count) {
+		return true
+	}
+	decodeAndSend(ctx, c.lines, c.pathname, count, b[:count], partial)
+	return false
+}